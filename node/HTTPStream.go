@@ -1,12 +1,17 @@
 package node
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -25,6 +30,11 @@ type HTTPStream struct {
 	certificates []tls.Certificate
 	ca           *ca.CA
 	rootCAs      *x509.CertPool
+
+	// socks5URL, when set, is used as a fallback transport for Dial if a
+	// direct connection and any HTTP_PROXY/HTTPS_PROXY configured in the
+	// environment both fail.
+	socks5URL *url.URL
 }
 
 func init() {
@@ -32,6 +42,7 @@ func init() {
 	stats.CounterInit("http_failed")
 	stats.CounterInit("http_served")
 	stats.CounterInit("http_accepted")
+	stats.CounterInit("http_verify_failed")
 }
 
 // NewHTTPStream will instantiate a new HTTPStream.
@@ -55,49 +66,251 @@ func NewHTTPStream(addr string, certificates []tls.Certificate, coreCA *ca.CA) (
 	return h, nil
 }
 
-// Dial will dial a remote http endpoint (and implement raft.StreamLayer).
+// SetSOCKS5Proxy configures an explicit SOCKS5 proxy to fall back to if a
+// direct connection and any environment-configured HTTP CONNECT proxy both
+// fail to reach the peer. proxyURL must be a "socks5://[user:password@]
+// host:port" URL; userinfo, if present, is used as the SOCKS5 auth
+// credentials.
+func (h *HTTPStream) SetSOCKS5Proxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid SOCKS5 proxy URL %q: %w", proxyURL, err)
+	}
+
+	if u.Scheme != "socks5" {
+		return fmt.Errorf("SOCKS5 proxy URL %q must use the socks5:// scheme", proxyURL)
+	}
+
+	h.socks5URL = u
+
+	return nil
+}
+
+// tlsConfig builds the tls.Config used to dial address. We set
+// InsecureSkipVerify because address is "host:port", which is not a valid
+// ServerName/DNSName, and verification is instead done manually in
+// VerifyPeerCertificate against h.rootCAs.
+func (h *HTTPStream) tlsConfig(address string) *tls.Config {
+	return &tls.Config{
+		Certificates:          h.certificates,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate(h.rootCAs, nodeDNSName(address)),
+	}
+}
+
+// nodeDNSName strips the port off of address (as used for raft.StreamLayer
+// dialing, "host:port") so it can be used as the DNSName to verify against.
+func nodeDNSName(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// verifyPeerCertificate returns a tls.Config.VerifyPeerCertificate callback
+// that parses the full chain the peer presented, and verifies it against
+// rootCAs for dnsName, using ExtKeyUsageAny since raft peer certificates
+// aren't necessarily issued for server or client auth specifically.
+func verifyPeerCertificate(rootCAs *x509.CertPool, dnsName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			stats.CounterInc("http_verify_failed", 1)
+			return errors.New("no certificate presented")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				stats.CounterInc("http_verify_failed", 1)
+				return err
+			}
+
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         rootCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			DNSName:       dnsName,
+		}
+
+		if _, err := certs[0].Verify(opts); err != nil {
+			stats.CounterInc("http_verify_failed", 1)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// Dial will dial a remote http endpoint (and implement raft.StreamLayer). It
+// is a thin shim over DialContext for callers that only have a flat timeout
+// to work with.
 func (h *HTTPStream) Dial(address string, timeout time.Duration) (net.Conn, error) {
-	var conn net.Conn
-	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	// Make a copy of our dialer to allow custom timeout.
-	dial := h.dial
-	dial.Timeout = timeout
+	return h.DialContext(ctx, address)
+}
 
+// DialContext dials a remote http endpoint, propagating ctx's deadline
+// through the proxy dial, the TLS handshake and the raft-0 upgrade, and
+// retrying transient failures with jittered exponential backoff (100ms to
+// 5s) so raft leader election doesn't thrash when a peer briefly restarts.
+func (h *HTTPStream) DialContext(ctx context.Context, address string) (net.Conn, error) {
 	if strings.IndexRune(address, ':') < 0 {
 		address += ":4934"
 	}
 
-	stats.CounterInc("http_dialed", 1)
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 5 * time.Second
+
+	for {
+		conn, err := h.dialOnce(ctx, address)
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil || !isRetryableDialErr(err) {
+			return nil, err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		logger.Debug("httpstream", "Retrying dial to %s in %s: %s", address, wait, err.Error())
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// dialOnce performs a single dial attempt: proxy-aware TCP connect, TLS
+// handshake, and the raft-0 HTTP Upgrade, reading back the response line so
+// we fail fast on a 400/401 instead of handing raft a dead connection.
+func (h *HTTPStream) dialOnce(ctx context.Context, address string) (net.Conn, error) {
+	dial := h.dial
+	if deadline, ok := ctx.Deadline(); ok {
+		dial.Deadline = deadline
+	}
 
+	stats.CounterInc("http_dialed", 1)
 	logger.Debug("httpstream", "Dialing %s", address)
 
-	conf := &tls.Config{
-		RootCAs:            h.rootCAs,
-		Certificates:       h.certificates,
-		ServerName:         address,
-		InsecureSkipVerify: true,
+	rawConn, err := h.proxyDial(dial, address)
+	if err != nil {
+		stats.CounterInc("http_failed", 1)
+		logger.Debug("httpstream", "Dial to %s failed: %s", address, err.Error())
+		return nil, err
 	}
-	conn, err = tls.DialWithDialer(&dial, "tcp", address, conf)
 
+	// Abort the dial/handshake/upgrade below as soon as ctx is done.
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rawConn.Close()
+		case <-stopWatch:
+		}
+	}()
+
+	conn, err := wrapTLS(rawConn, h.tlsConfig(address), remainingOrDefault(ctx, 10*time.Second))
 	if err != nil {
 		stats.CounterInc("http_failed", 1)
-		fmt.Printf("ERRRRRROR %s\n", err.Error())
+		logger.Debug("httpstream", "TLS handshake with %s failed: %s", address, err.Error())
 		return nil, err
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
 	// We use Upgrade, and hope that will make proxies happy.
-	open := fmt.Sprintf("GET %s/raft HTTP/1.1\nHost: %s\nUpgrade: raft-0\n\n", cluster.CorePrefix, address)
+	open := fmt.Sprintf("GET %s/raft HTTP/1.1\r\nHost: %s\r\nUpgrade: raft-0\r\n\r\n", cluster.CorePrefix, address)
 
-	_, err = conn.Write([]byte(open))
-	if err != nil {
+	if _, err := conn.Write([]byte(open)); err != nil {
 		conn.Close()
+		stats.CounterInc("http_failed", 1)
+		logger.Debug("httpstream", "Writing raft-0 upgrade to %s failed: %s", address, err.Error())
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
 
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
 		stats.CounterInc("http_failed", 1)
+		logger.Debug("httpstream", "Reading raft-0 upgrade response from %s failed: %s", address, err.Error())
 		return nil, err
 	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		stats.CounterInc("http_failed", 1)
+		return nil, fmt.Errorf("raft-0 upgrade to %s failed: %s", address, resp.Status)
+	}
 
-	return conn, nil
+	conn.SetDeadline(time.Time{})
+
+	// reader's bufio.Reader may already hold raft bytes that arrived in the
+	// same read as the "101" response line; keep serving out of it instead
+	// of going back to conn directly, or those bytes would be lost.
+	return &bufferedConn{Conn: conn, r: reader}, nil
+}
+
+// bufferedConn adapts a net.Conn whose initial bytes have already been
+// consumed into a bufio.Reader (typically while parsing an HTTP response
+// line) so that Read keeps draining that buffer before falling back to the
+// underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn.
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// remainingOrDefault returns the time left until ctx's deadline, or
+// fallback if ctx has none.
+func remainingOrDefault(ctx context.Context, fallback time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return fallback
+	}
+
+	return time.Until(deadline)
+}
+
+// isRetryableDialErr reports whether err looks like a transient failure
+// worth retrying (connection reset/refused mid-handshake, peer not yet
+// listening again after a restart) rather than a permanent one.
+func isRetryableDialErr(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -172,5 +385,9 @@ func (h *HTTPStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	conn.SetDeadline(time.Time{})
 	conn.SetWriteDeadline(time.Time{})
 
+	// Let DialContext's bufio.Reader see a real response line instead of
+	// raft-0 bytes straight away.
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: raft-0\r\n\r\n"))
+
 	h.accepted <- conn
 }
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func generateTestCA(t *testing.T, commonName string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+
+	return cert, key
+}
+
+func generateTestLeaf(t *testing.T, dnsName string, ca *x509.Certificate, caKey *rsa.PrivateKey) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate leaf key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create leaf certificate: %s", err)
+	}
+
+	return der
+}
+
+// TestVerifyPeerCertificateRejectsUnrelatedCA makes sure a certificate
+// signed by a CA we don't trust is rejected, and one signed by our actual
+// root still verifies.
+func TestVerifyPeerCertificateRejectsUnrelatedCA(t *testing.T) {
+	trustedCA, trustedKey := generateTestCA(t, "trusted-ca")
+	rogueCA, rogueKey := generateTestCA(t, "rogue-ca")
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(trustedCA)
+
+	verify := verifyPeerCertificate(rootCAs, "node1")
+
+	rogueLeaf := generateTestLeaf(t, "node1", rogueCA, rogueKey)
+	if err := verify([][]byte{rogueLeaf}, nil); err == nil {
+		t.Fatal("expected a certificate signed by an unrelated CA to be rejected")
+	}
+
+	trustedLeaf := generateTestLeaf(t, "node1", trustedCA, trustedKey)
+	if err := verify([][]byte{trustedLeaf}, nil); err != nil {
+		t.Fatalf("expected a certificate signed by the trusted CA to verify, got: %s", err)
+	}
+}
+
+// TestNodeDNSName checks the host:port stripping used to derive the DNSName
+// verified against.
+func TestNodeDNSName(t *testing.T) {
+	cases := map[string]string{
+		"node1:4934": "node1",
+		"node1":      "node1",
+	}
+
+	for address, want := range cases {
+		if got := nodeDNSName(address); got != want {
+			t.Errorf("nodeDNSName(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package node
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gansoi/gansoi/ca"
+	"github.com/gansoi/gansoi/cluster"
+	"github.com/gansoi/gansoi/logger"
+	"github.com/gansoi/gansoi/stats"
+)
+
+func init() {
+	stats.CounterInit("revdial_dialed")
+	stats.CounterInit("revdial_failed")
+	stats.CounterInit("revdial_accepted")
+}
+
+// revdialFrame is sent down a control connection to ask the node on the
+// other end to open a new outbound data connection.
+type revdialFrame struct {
+	ConnID int64 `json:"connID"`
+}
+
+// ReverseHTTPStream implements raft.StreamLayer for nodes that cannot be
+// dialed directly, such as satellite/edge agents sitting behind NAT. The
+// NAT'd node maintains a long-lived outbound control connection to the
+// cluster leader (see NewReverseHTTPStreamClient); whenever the leader needs
+// to talk to that node, it asks over the control channel for a fresh
+// outbound data connection instead of dialing in. Each control frame
+// therefore results in exactly one extra TCP connection.
+type ReverseHTTPStream struct {
+	*HTTPStream
+
+	mu         sync.Mutex
+	controls   map[string]*controlConn // node ID -> open control connection
+	pending    map[int64]chan net.Conn
+	nextID     int64
+	clientConn net.Conn // set by connectControl on the NAT'd client side only
+}
+
+// controlConn pairs a control connection with the mutex guarding writes to
+// it, since raft may call Dial for the same peer from more than one
+// goroutine at once and a revdialFrame must not interleave with another.
+type controlConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// NewReverseHTTPStream instantiates a new ReverseHTTPStream for use on the
+// side that accepts control connections (normally the cluster leader).
+func NewReverseHTTPStream(addr string, certificates []tls.Certificate, coreCA *ca.CA) (*ReverseHTTPStream, error) {
+	base, err := NewHTTPStream(addr, certificates, coreCA)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReverseHTTPStream{
+		HTTPStream: base,
+		controls:   make(map[string]*controlConn),
+		pending:    make(map[int64]chan net.Conn),
+	}
+
+	return r, nil
+}
+
+// NewReverseHTTPStreamClient instantiates a ReverseHTTPStream that maintains
+// a persistent, reconnecting control connection to leaderAddr. Use this on
+// NAT'd nodes that can only make outbound connections.
+func NewReverseHTTPStreamClient(leaderAddr string, certificates []tls.Certificate, coreCA *ca.CA) (*ReverseHTTPStream, error) {
+	r, err := NewReverseHTTPStream(leaderAddr, certificates, coreCA)
+	if err != nil {
+		return nil, err
+	}
+
+	go r.clientLoop(leaderAddr)
+
+	return r, nil
+}
+
+// Dial implements raft.StreamLayer. If address has a live control
+// connection registered (i.e. address is a NAT'd node that connected to us),
+// a reverse dial is performed over that control connection. Otherwise this
+// falls back to a normal, direct HTTPStream dial.
+func (r *ReverseHTTPStream) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	// controls is keyed by node ID (the peer cert's bare CommonName, set in
+	// registerControl), while address is a raft host:port. Strip the port
+	// the same way nodeDNSName does so the two sides actually line up.
+	nodeID := nodeDNSName(address)
+
+	r.mu.Lock()
+	control, ok := r.controls[nodeID]
+	r.mu.Unlock()
+
+	if !ok {
+		return r.HTTPStream.Dial(address, timeout)
+	}
+
+	return r.dialReverse(control, address, timeout)
+}
+
+// dialReverse asks the node on the other end of control to open a new data
+// connection back to us, and waits for it to arrive.
+func (r *ReverseHTTPStream) dialReverse(control *controlConn, address string, timeout time.Duration) (net.Conn, error) {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	ch := make(chan net.Conn, 1)
+	r.pending[id] = ch
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	stats.CounterInc("revdial_dialed", 1)
+
+	logger.Debug("revdial", "Asking %s to open data connection %d", address, id)
+
+	control.writeMu.Lock()
+	err := json.NewEncoder(control).Encode(revdialFrame{ConnID: id})
+	control.writeMu.Unlock()
+
+	if err != nil {
+		stats.CounterInc("revdial_failed", 1)
+		return nil, err
+	}
+
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-time.After(timeout):
+		stats.CounterInc("revdial_failed", 1)
+		return nil, fmt.Errorf("timed out waiting for %s to open data connection %d", address, id)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface for /core/revdial. It
+// accepts both the control connection a NAT'd node keeps open, and the data
+// connections it opens on demand.
+func (r *ReverseHTTPStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	role := req.Header.Get("X-Revdial-Role")
+	if role == "" {
+		r.HTTPStream.ServeHTTP(w, req)
+		return
+	}
+
+	if r.closed {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	_, err := r.ca.VerifyHTTPRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch role {
+	case "control":
+		r.registerControl(peerNodeID(conn), conn)
+
+	case "data":
+		id, err := strconv.ParseInt(req.Header.Get("X-Revdial-ConnID"), 10, 64)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		r.completeData(id, conn)
+
+	default:
+		conn.Close()
+	}
+}
+
+// peerNodeID derives the remote node ID from the verified client
+// certificate presented on conn.
+func peerNodeID(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	return certs[0].Subject.CommonName
+}
+
+// registerControl stores conn as the control connection for nodeID until it
+// is closed, at which point it is deregistered again.
+func (r *ReverseHTTPStream) registerControl(nodeID string, conn net.Conn) {
+	control := &controlConn{Conn: conn}
+
+	r.mu.Lock()
+	r.controls[nodeID] = control
+	r.mu.Unlock()
+
+	logger.Debug("revdial", "Registered control connection for %s", nodeID)
+
+	// Block here until the connection is closed by the other end, so we
+	// notice and can deregister it.
+	one := make([]byte, 1)
+	conn.Read(one)
+
+	r.mu.Lock()
+	if r.controls[nodeID] == control {
+		delete(r.controls, nodeID)
+	}
+	r.mu.Unlock()
+
+	conn.Close()
+}
+
+// completeData hands a freshly opened data connection to whoever is waiting
+// for it in dialReverse.
+func (r *ReverseHTTPStream) completeData(id int64, conn net.Conn) {
+	r.mu.Lock()
+	ch, ok := r.pending[id]
+	r.mu.Unlock()
+
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	stats.CounterInc("revdial_accepted", 1)
+	ch <- conn
+}
+
+// clientLoop keeps a control connection to leaderAddr alive, reconnecting
+// with jittered exponential backoff whenever it drops.
+func (r *ReverseHTTPStream) clientLoop(leaderAddr string) {
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 30 * time.Second
+
+	for !r.closed {
+		err := r.connectControl(leaderAddr)
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			continue
+		}
+
+		logger.Debug("revdial", "Control connection to %s failed: %s", leaderAddr, err.Error())
+
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1))))
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connectControl opens a single control connection to leaderAddr and serves
+// it until it breaks, opening a new outbound data connection for every
+// revdialFrame received.
+func (r *ReverseHTTPStream) connectControl(leaderAddr string) error {
+	dial := r.dial
+	dial.Timeout = 10 * time.Second
+
+	conf := r.tlsConfig(leaderAddr)
+
+	raw, err := r.proxyDial(dial, leaderAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := wrapTLS(raw, conf, dial.Timeout)
+	if err != nil {
+		return err
+	}
+
+	open := fmt.Sprintf("GET %s/revdial HTTP/1.1\r\nHost: %s\r\nUpgrade: revdial-control\r\nX-Revdial-Role: control\r\n\r\n", cluster.CorePrefix, leaderAddr)
+	if _, err := conn.Write([]byte(open)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	logger.Debug("revdial", "Control connection to %s established", leaderAddr)
+
+	r.mu.Lock()
+	r.clientConn = conn
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.clientConn == conn {
+			r.clientConn = nil
+		}
+		r.mu.Unlock()
+	}()
+
+	dec := json.NewDecoder(conn)
+	for {
+		var frame revdialFrame
+		if err := dec.Decode(&frame); err != nil {
+			conn.Close()
+			return err
+		}
+
+		go r.openData(leaderAddr, frame.ConnID)
+	}
+}
+
+// openData opens one outbound data connection in response to a revdialFrame
+// and feeds it into our own Accept(), since it represents an incoming raft
+// stream from the leader's point of view.
+func (r *ReverseHTTPStream) openData(leaderAddr string, connID int64) {
+	dial := r.dial
+	dial.Timeout = 10 * time.Second
+
+	conf := r.tlsConfig(leaderAddr)
+
+	raw, err := r.proxyDial(dial, leaderAddr)
+	if err != nil {
+		logger.Debug("revdial", "Failed to open data connection %d to %s: %s", connID, leaderAddr, err.Error())
+		return
+	}
+
+	conn, err := wrapTLS(raw, conf, dial.Timeout)
+	if err != nil {
+		logger.Debug("revdial", "TLS handshake for data connection %d to %s failed: %s", connID, leaderAddr, err.Error())
+		return
+	}
+
+	open := fmt.Sprintf("GET %s/revdial HTTP/1.1\r\nHost: %s\r\nUpgrade: revdial-data\r\nX-Revdial-Role: data\r\nX-Revdial-ConnID: %d\r\n\r\n", cluster.CorePrefix, leaderAddr, connID)
+	if _, err := conn.Write([]byte(open)); err != nil {
+		conn.Close()
+		return
+	}
+
+	r.accepted <- conn
+}
+
+// Close tears down both the control connection(s) and the underlying
+// HTTPStream. This covers both roles: the accepting side's registered
+// control connections in r.controls, and the NAT'd client side's own
+// outbound control connection, which clientLoop stores in r.clientConn
+// since it is never registered anywhere else. Closing clientConn also
+// unblocks connectControl's dec.Decode, so clientLoop observes r.closed
+// (set below via HTTPStream.Close) and stops reconnecting.
+func (r *ReverseHTTPStream) Close() error {
+	err := r.HTTPStream.Close()
+
+	r.mu.Lock()
+	for _, control := range r.controls {
+		control.Close()
+	}
+	r.controls = make(map[string]*controlConn)
+
+	if r.clientConn != nil {
+		r.clientConn.Close()
+	}
+	r.mu.Unlock()
+
+	return err
+}
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDialReverse simulates a NAT'd node: it never accepts inbound dials,
+// only reads revdialFrames off its control connection and hands back a
+// freshly "dialed" data connection for each one, exactly like
+// ReverseHTTPStream.openData does over the wire. This exercises
+// Dial/dialReverse/completeData end to end without needing the real mTLS
+// listener stack.
+func TestDialReverse(t *testing.T) {
+	controlServer, controlClient := net.Pipe()
+	defer controlServer.Close()
+	defer controlClient.Close()
+
+	r := &ReverseHTTPStream{
+		HTTPStream: &HTTPStream{accepted: make(chan net.Conn)},
+		controls:   map[string]*controlConn{"node1": {Conn: controlServer}},
+		pending:    make(map[int64]chan net.Conn),
+	}
+
+	nodeEnds := make(chan net.Conn, 1)
+
+	// The simulated NAT'd node: only ever dials out, never accepts.
+	go func() {
+		dec := json.NewDecoder(controlClient)
+
+		for {
+			var frame revdialFrame
+			if err := dec.Decode(&frame); err != nil {
+				return
+			}
+
+			dataForLeader, dataForNode := net.Pipe()
+			nodeEnds <- dataForNode
+
+			r.completeData(frame.ConnID, dataForLeader)
+		}
+	}()
+
+	conn, err := r.Dial("node1", time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	nodeConn := <-nodeEnds
+	defer nodeConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 4)
+		nodeConn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := nodeConn.Read(buf); err != nil {
+			t.Errorf("read on node side failed: %s", err)
+			return
+		}
+
+		if string(buf) != "ping" {
+			t.Errorf("expected %q, got %q", "ping", buf)
+		}
+	}()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write on leader side failed: %s", err)
+	}
+
+	<-done
+}
+
+// TestDialFallsBackToDirect confirms that Dial falls back to a plain
+// HTTPStream dial when no control connection is registered for address.
+func TestDialFallsBackToDirect(t *testing.T) {
+	r := &ReverseHTTPStream{
+		HTTPStream: &HTTPStream{accepted: make(chan net.Conn)},
+		controls:   make(map[string]*controlConn),
+		pending:    make(map[int64]chan net.Conn),
+	}
+
+	_, err := r.Dial("127.0.0.1:1", time.Millisecond)
+	if err == nil {
+		t.Fatal("expected dialing an address with no control connection and nothing listening to fail")
+	}
+}
+
+// TestDialStripsPortBeforeLookup registers a control connection the way
+// ServeHTTP/registerControl do on the accepting side (keyed by the bare node
+// ID) and then dials the raft host:port address for that node, to make sure
+// Dial strips the port before comparing against r.controls the same way
+// nodeDNSName does. An address of "node1:1" has nothing listening on it, so
+// if Dial fell through to a direct HTTPStream.Dial instead of reverse
+// dialing over the control connection, this would fail instead of
+// round-tripping.
+func TestDialStripsPortBeforeLookup(t *testing.T) {
+	controlServer, controlClient := net.Pipe()
+	defer controlClient.Close()
+
+	r := &ReverseHTTPStream{
+		HTTPStream: &HTTPStream{accepted: make(chan net.Conn)},
+		controls:   make(map[string]*controlConn),
+		pending:    make(map[int64]chan net.Conn),
+	}
+
+	go r.registerControl("node1", controlServer)
+
+	// registerControl runs on its own goroutine; wait until it has stored
+	// the control connection before dialing.
+	for registered := false; !registered; {
+		r.mu.Lock()
+		_, registered = r.controls["node1"]
+		r.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	nodeEnds := make(chan net.Conn, 1)
+	go func() {
+		dec := json.NewDecoder(controlClient)
+
+		for {
+			var frame revdialFrame
+			if err := dec.Decode(&frame); err != nil {
+				return
+			}
+
+			dataForLeader, dataForNode := net.Pipe()
+			nodeEnds <- dataForNode
+
+			r.completeData(frame.ConnID, dataForLeader)
+		}
+	}()
+
+	conn, err := r.Dial("node1:1", time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	nodeConn := <-nodeEnds
+	defer nodeConn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write on leader side failed: %s", err)
+	}
+
+	buf := make([]byte, 4)
+	nodeConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := nodeConn.Read(buf); err != nil {
+		t.Fatalf("read on node side failed: %s", err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected %q, got %q", "ping", buf)
+	}
+}
+
+// TestCloseTearsDownClientControlConn confirms that Close closes the NAT'd
+// client side's own outbound control connection (stashed in r.clientConn by
+// connectControl), not just entries in r.controls, which only the accepting
+// side ever populates.
+func TestCloseTearsDownClientControlConn(t *testing.T) {
+	clientSide, leaderSide := net.Pipe()
+	defer leaderSide.Close()
+
+	r := &ReverseHTTPStream{
+		HTTPStream: &HTTPStream{accepted: make(chan net.Conn)},
+		controls:   make(map[string]*controlConn),
+		pending:    make(map[int64]chan net.Conn),
+		clientConn: clientSide,
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	one := make([]byte, 1)
+	clientSide.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clientSide.Read(one); err == nil {
+		t.Fatal("expected the client-side control connection to be closed")
+	}
+}
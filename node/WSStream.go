@@ -0,0 +1,232 @@
+package node
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/gansoi/gansoi/ca"
+	"github.com/gansoi/gansoi/cluster"
+	"github.com/gansoi/gansoi/logger"
+	"github.com/gansoi/gansoi/stats"
+)
+
+func init() {
+	stats.CounterInit("ws_dialed")
+	stats.CounterInit("ws_failed")
+	stats.CounterInit("ws_served")
+	stats.CounterInit("ws_accepted")
+}
+
+// wsPingInterval matches the KeepAlive HTTPStream's dialer uses, so both
+// transports look the same to NAT devices that drop idle connections.
+const wsPingInterval = 25 * time.Second
+
+// WSStream implements raft.StreamLayer like HTTPStream, but frames the raft
+// bytestream as websocket messages on /core/raft-ws instead of relying on
+// http.Hijacker after an "Upgrade: raft-0" handshake. The trade-off: plain
+// HTTP/1.1 websocket upgrades survive L7 load balancers, HTTP/2 terminators
+// and other middleboxes that won't forward an arbitrary Upgrade token end
+// to end, at the cost of a little per-message framing overhead that
+// HTTPStream's raw hijacked TCP stream doesn't pay. Pick whichever matches
+// what sits between your cluster members.
+type WSStream struct {
+	*HTTPStream
+
+	upgrader websocket.Upgrader
+}
+
+// NewWSStream instantiates a new WSStream.
+func NewWSStream(addr string, certificates []tls.Certificate, coreCA *ca.CA) (*WSStream, error) {
+	base, err := NewHTTPStream(addr, certificates, coreCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WSStream{
+		HTTPStream: base,
+	}, nil
+}
+
+// Dial will dial a remote http endpoint over websocket (and implement
+// raft.StreamLayer).
+func (w *WSStream) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	if strings.IndexRune(address, ':') < 0 {
+		address += ":4934"
+	}
+
+	stats.CounterInc("ws_dialed", 1)
+	logger.Debug("wsstream", "Dialing %s", address)
+
+	dial := w.dial
+	dial.Timeout = timeout
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  w.tlsConfig(address),
+		HandshakeTimeout: timeout,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return w.proxyDial(dial, addr)
+		},
+	}
+
+	u := url.URL{Scheme: "wss", Host: address, Path: cluster.CorePrefix + "/raft-ws"}
+
+	conn, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		stats.CounterInc("ws_failed", 1)
+		return nil, err
+	}
+
+	return newWSConn(conn), nil
+}
+
+// ServeHTTP implements the http.Handler interface for /core/raft-ws.
+func (w *WSStream) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	stats.CounterInc("ws_served", 1)
+
+	if w.closed {
+		http.Error(rw, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	_, err := w.ca.VerifyHTTPRequest(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := w.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		logger.Debug("wsstream", "Upgrade from %s failed: %s", r.RemoteAddr, err.Error())
+		return
+	}
+
+	stats.CounterInc("ws_accepted", 1)
+
+	w.accepted <- newWSConn(conn)
+}
+
+// Accept waits for and returns the next connection to the listener. This
+// shadows the embedded HTTPStream.Accept rather than inheriting it, since
+// that one also increments http_accepted for every connection it dequeues;
+// ServeHTTP above already counts every accepted raft-ws connection under
+// ws_accepted, and we don't want the two transports' accept counts
+// conflated under the same metric.
+func (w *WSStream) Accept() (net.Conn, error) {
+	if w.closed {
+		return nil, errors.New("Server is shutting down")
+	}
+
+	return <-w.accepted, nil
+}
+
+// wsConn adapts a *websocket.Conn to net.Conn so it can be used as a raft
+// stream: each websocket message is treated as one frame of the underlying
+// bytestream, with reads buffering any bytes a message didn't fit into the
+// caller's slice. It also sends a ping frame every wsPingInterval, matching
+// HTTPStream's TCP keepalive behaviour.
+type wsConn struct {
+	*websocket.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done chan struct{}
+	once sync.Once
+
+	// writeMu serializes WriteMessage/WriteControl calls, since
+	// gorilla/websocket only supports one concurrent writer and both Write
+	// and the ping ticker in pingLoop write to the same connection.
+	writeMu sync.Mutex
+}
+
+func newWSConn(c *websocket.Conn) *wsConn {
+	w := &wsConn{
+		Conn: c,
+		done: make(chan struct{}),
+	}
+
+	go w.pingLoop()
+
+	return w
+}
+
+func (w *wsConn) pingLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(5 * time.Second)
+
+			w.writeMu.Lock()
+			err := w.Conn.WriteControl(websocket.PingMessage, nil, deadline)
+			w.writeMu.Unlock()
+
+			if err != nil {
+				return
+			}
+
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Read implements net.Conn, reassembling across websocket message
+// boundaries as needed.
+func (w *wsConn) Read(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		_, data, err := w.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		w.buf = data
+	}
+
+	n := copy(p, w.buf)
+	w.buf = w.buf[n:]
+
+	return n, nil
+}
+
+// Write implements net.Conn, sending p as a single binary websocket
+// message.
+func (w *wsConn) Write(p []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if err := w.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close implements net.Conn.
+func (w *wsConn) Close() error {
+	w.once.Do(func() { close(w.done) })
+
+	return w.Conn.Close()
+}
+
+// SetDeadline implements net.Conn on top of the websocket.Conn's separate
+// read/write deadlines.
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return w.Conn.SetWriteDeadline(t)
+}
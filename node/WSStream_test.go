@@ -0,0 +1,157 @@
+package node
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWSEchoServer starts an httptest server that upgrades every request to
+// a websocket and hands the server-side wsConn to the returned channel, so
+// the test can drive both ends of the same transport that ServeHTTP/Dial
+// use in production.
+func startWSEchoServer(t *testing.T) (*httptest.Server, chan *wsConn) {
+	t.Helper()
+
+	conns := make(chan *wsConn, 1)
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("server upgrade failed: %s", err)
+			return
+		}
+
+		conns <- newWSConn(c)
+	}))
+
+	return srv, conns
+}
+
+func dialWS(t *testing.T, srv *httptest.Server) *wsConn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("client dial failed: %s", err)
+	}
+
+	return newWSConn(c)
+}
+
+// TestWSConnRoundtrip exercises wsConn as a net.Conn in both directions over
+// a real websocket connection, the same path Dial/ServeHTTP hand raft.
+func TestWSConnRoundtrip(t *testing.T) {
+	srv, conns := startWSEchoServer(t)
+	defer srv.Close()
+
+	client := dialWS(t, srv)
+	defer client.Close()
+
+	server := <-conns
+	defer server.Close()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write failed: %s", err)
+	}
+
+	buf := make([]byte, 4)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("server read failed: %s", err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected %q, got %q", "ping", buf)
+	}
+}
+
+// TestWSConnReadAcrossShortBuffers checks that a message larger than the
+// caller's read buffer is reassembled across multiple Read calls instead of
+// dropping the remainder, since unlike HTTPStream's raw TCP stream, a
+// websocket message has a boundary that Read must not lose track of.
+func TestWSConnReadAcrossShortBuffers(t *testing.T) {
+	srv, conns := startWSEchoServer(t)
+	defer srv.Close()
+
+	client := dialWS(t, srv)
+	defer client.Close()
+
+	server := <-conns
+	defer server.Close()
+
+	if _, err := client.Write([]byte("pingpong")); err != nil {
+		t.Fatalf("client write failed: %s", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	got := make([]byte, 0, 8)
+	buf := make([]byte, 4)
+	for len(got) < 8 {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("server read failed: %s", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+
+	if string(got) != "pingpong" {
+		t.Fatalf("expected %q, got %q", "pingpong", got)
+	}
+}
+
+// TestWSConnWriteDuringPing documents and guards the trade-off wsConn makes
+// against HTTPStream: a *websocket.Conn only tolerates one writer at a time,
+// so Write and pingLoop's keepalive frames must serialize through writeMu.
+// The ping here is sent from its own goroutine under writeMu, the way
+// pingLoop sends keepalives, while Write sends a message; the server must
+// still read that message intact.
+func TestWSConnWriteDuringPing(t *testing.T) {
+	srv, conns := startWSEchoServer(t)
+	defer srv.Close()
+
+	client := dialWS(t, srv)
+	defer client.Close()
+
+	server := <-conns
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 4)
+		server.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Errorf("server read failed: %s", err)
+		}
+	}()
+
+	// Force a ping frame to race with the message write below; pingLoop and
+	// Write must not corrupt each other's frame on the wire.
+	pingErr := make(chan error, 1)
+	go func() {
+		client.writeMu.Lock()
+		defer client.writeMu.Unlock()
+		pingErr <- client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	}()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write failed: %s", err)
+	}
+
+	if err := <-pingErr; err != nil {
+		t.Fatalf("ping write failed: %s", err)
+	}
+
+	<-done
+}
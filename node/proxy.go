@@ -0,0 +1,129 @@
+package node
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/gansoi/gansoi/logger"
+	"github.com/gansoi/gansoi/stats"
+)
+
+func init() {
+	stats.CounterInit("http_proxied")
+	stats.CounterInit("http_proxy_failed")
+}
+
+// proxyDial tries to establish a raw (non-TLS) connection to address,
+// either directly, through an HTTP CONNECT proxy (as configured through the
+// usual HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables), or through
+// an explicit SOCKS5 proxy. The first method that succeeds wins.
+func (h *HTTPStream) proxyDial(dial net.Dialer, address string) (net.Conn, error) {
+	conn, err := dial.Dial("tcp", address)
+	if err == nil {
+		return conn, nil
+	}
+	directErr := err
+
+	if proxyURL, perr := h.httpProxyURL(address); perr == nil && proxyURL != nil {
+		conn, err = dialHTTPConnect(dial, proxyURL, address)
+		if err == nil {
+			stats.CounterInc("http_proxied", 1)
+			return conn, nil
+		}
+
+		stats.CounterInc("http_proxy_failed", 1)
+		logger.Debug("httpstream", "CONNECT via %s failed: %s", proxyURL, err.Error())
+	}
+
+	if h.socks5URL != nil {
+		conn, err = dialSOCKS5(dial, h.socks5URL, address)
+		if err == nil {
+			stats.CounterInc("http_proxied", 1)
+			return conn, nil
+		}
+
+		stats.CounterInc("http_proxy_failed", 1)
+		logger.Debug("httpstream", "SOCKS5 via %s failed: %s", h.socks5URL.Host, err.Error())
+	}
+
+	return nil, directErr
+}
+
+// httpProxyURL resolves the HTTP CONNECT proxy to use for address, honoring
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY the same way net/http does.
+func (h *HTTPStream) httpProxyURL(address string) (*url.URL, error) {
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: address}}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// dialHTTPConnect dials proxyURL and issues a CONNECT request for address,
+// returning the raw tunnelled connection once the proxy confirms it.
+func dialHTTPConnect(dial net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	conn, err := dial.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", address, resp.Status)
+	}
+
+	return conn, nil
+}
+
+// dialSOCKS5 dials address through the SOCKS5 proxy identified by proxyURL,
+// authenticating with its userinfo if present.
+func dialSOCKS5(dial net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{
+			User:     proxyURL.User.Username(),
+			Password: password,
+		}
+	}
+
+	d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, &dial)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Dial("tcp", address)
+}
+
+// wrapTLS performs a client-side TLS handshake on top of an already
+// established raw connection, used once a direct/CONNECT/SOCKS5 transport
+// has been selected.
+func wrapTLS(conn net.Conn, conf *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, conf)
+
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
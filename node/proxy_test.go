@@ -0,0 +1,226 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a TCP listener that echoes back whatever is
+// written to it, standing in for the real node on the other end of a
+// proxied dial.
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	return l
+}
+
+func roundtrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected echoed %q, got %q", "ping", buf)
+	}
+}
+
+// TestDialHTTPConnect drives dialHTTPConnect against an in-process
+// httputil-style CONNECT proxy.
+func TestDialHTTPConnect(t *testing.T) {
+	target := startEchoServer(t)
+	defer target.Close()
+
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "expected CONNECT", http.StatusBadRequest)
+			return
+		}
+
+		destConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer destConn.Close()
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "can't hijack", http.StatusInternalServerError)
+			return
+		}
+
+		clientConn, _, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+
+		clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+		go io.Copy(destConn, clientConn)
+		io.Copy(clientConn, destConn)
+	}))
+	defer proxySrv.Close()
+
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %s", err)
+	}
+
+	conn, err := dialHTTPConnect(net.Dialer{Timeout: time.Second}, proxyURL, target.Addr().String())
+	if err != nil {
+		t.Fatalf("dialHTTPConnect failed: %s", err)
+	}
+	defer conn.Close()
+
+	roundtrip(t, conn)
+}
+
+// startMinimalSOCKS5Server starts a listener that implements just enough of
+// RFC 1928 (no auth
+// negotiation success, CONNECT, IPv4/domain addresses) to exercise
+// dialSOCKS5, without pulling in a third-party SOCKS5 server dependency
+// that would only ever be used by this test.
+func startMinimalSOCKS5Server(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SOCKS5 server: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveSOCKS5(conn)
+		}
+	}()
+
+	return l
+}
+
+func serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+
+	// No authentication required.
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+
+	reqHeader := make([]byte, 4)
+	if _, err := io.ReadFull(r, reqHeader); err != nil {
+		return
+	}
+
+	var host string
+	switch reqHeader[3] {
+	case 0x01: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+
+	case 0x03: // domain name
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return
+		}
+		host = string(domain)
+
+	default:
+		return
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBytes); err != nil {
+		return
+	}
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+
+	target, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+// TestDialSOCKS5 drives dialSOCKS5 against an in-process SOCKS5 listener.
+func TestDialSOCKS5(t *testing.T) {
+	target := startEchoServer(t)
+	defer target.Close()
+
+	socks := startMinimalSOCKS5Server(t)
+	defer socks.Close()
+
+	proxyURL, err := url.Parse("socks5://" + socks.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %s", err)
+	}
+
+	conn, err := dialSOCKS5(net.Dialer{Timeout: time.Second}, proxyURL, target.Addr().String())
+	if err != nil {
+		t.Fatalf("dialSOCKS5 failed: %s", err)
+	}
+	defer conn.Close()
+
+	roundtrip(t, conn)
+}
@@ -0,0 +1,42 @@
+package node
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/gansoi/gansoi/ca"
+)
+
+// Transport identifies which raft.StreamLayer implementation a node should
+// use.
+type Transport string
+
+const (
+	// TransportHTTP is the original "Upgrade: raft-0" + http.Hijacker
+	// transport (HTTPStream). Lowest overhead, but relies on L7
+	// infrastructure forwarding an arbitrary Upgrade token end to end.
+	TransportHTTP Transport = "raft-0"
+
+	// TransportWebSocket frames the raft bytestream as websocket messages
+	// (WSStream), trading a little per-message overhead for compatibility
+	// with load balancers and HTTP/2 terminators that won't pass through
+	// "Upgrade: raft-0".
+	TransportWebSocket Transport = "raft-ws"
+)
+
+// NewStreamLayer instantiates the raft.StreamLayer selected by transport.
+// An empty transport defaults to TransportHTTP for backwards compatibility.
+func NewStreamLayer(transport Transport, addr string, certificates []tls.Certificate, coreCA *ca.CA) (raft.StreamLayer, error) {
+	switch transport {
+	case TransportHTTP, "":
+		return NewHTTPStream(addr, certificates, coreCA)
+
+	case TransportWebSocket:
+		return NewWSStream(addr, certificates, coreCA)
+
+	default:
+		return nil, fmt.Errorf("unknown raft transport %q", transport)
+	}
+}
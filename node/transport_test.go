@@ -0,0 +1,74 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/gansoi/gansoi/ca"
+)
+
+// TestNewStreamLayer checks that each supported Transport resolves to the
+// matching raft.StreamLayer implementation, that an empty Transport keeps
+// defaulting to TransportHTTP for backwards compatibility, and that an
+// unknown Transport is rejected instead of silently falling back to one.
+func TestNewStreamLayer(t *testing.T) {
+	coreCA := &ca.CA{}
+
+	cases := []struct {
+		name      string
+		transport Transport
+		wantErr   bool
+		check     func(t *testing.T, layer interface{})
+	}{
+		{
+			name:      "http",
+			transport: TransportHTTP,
+			check: func(t *testing.T, layer interface{}) {
+				if _, ok := layer.(*HTTPStream); !ok {
+					t.Errorf("TransportHTTP produced %T, want *HTTPStream", layer)
+				}
+			},
+		},
+		{
+			name:      "empty defaults to http",
+			transport: "",
+			check: func(t *testing.T, layer interface{}) {
+				if _, ok := layer.(*HTTPStream); !ok {
+					t.Errorf("empty Transport produced %T, want *HTTPStream", layer)
+				}
+			},
+		},
+		{
+			name:      "websocket",
+			transport: TransportWebSocket,
+			check: func(t *testing.T, layer interface{}) {
+				if _, ok := layer.(*WSStream); !ok {
+					t.Errorf("TransportWebSocket produced %T, want *WSStream", layer)
+				}
+			},
+		},
+		{
+			name:      "unknown",
+			transport: "raft-carrier-pigeon",
+			wantErr:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			layer, err := NewStreamLayer(c.transport, "node1:4934", nil, coreCA)
+
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("NewStreamLayer(%q) expected an error, got none", c.transport)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewStreamLayer(%q) failed: %s", c.transport, err)
+			}
+
+			c.check(t, layer)
+		})
+	}
+}
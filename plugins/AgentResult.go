@@ -1,17 +1,394 @@
 package plugins
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+
+	"github.com/gansoi/gansoi/logger"
+)
+
+// ResultType identifies the kind of value a ResultField holds.
+type ResultType string
+
+const (
+	// Gauge is a point-in-time numeric measurement, e.g. a temperature or a
+	// queue depth.
+	Gauge ResultType = "gauge"
+
+	// Counter is a monotonically increasing numeric measurement.
+	Counter ResultType = "counter"
+
+	// String is a free-form text value.
+	String ResultType = "string"
+
+	// Bool is a true/false value.
+	Bool ResultType = "bool"
+
+	// DurationType is a time.Duration value.
+	DurationType ResultType = "duration"
+)
+
+// ResultField describes one value an agent can add to its AgentResult.
+type ResultField struct {
+	Name string
+	Type ResultType
+	Unit string
+}
+
+// ResultSchema describes every field an agent can populate in its
+// AgentResult. Evaluators can use it to resolve a threshold expression like
+// ">100ms" or "<5MB" against the field it applies to instead of comparing
+// raw floats blind to their units.
+type ResultSchema []ResultField
+
+func (s ResultSchema) field(name string) (ResultField, bool) {
+	for _, f := range s {
+		if f.Name == name {
+			return f, true
+		}
+	}
+
+	return ResultField{}, false
+}
+
+// resultValue is what AgentResult stores per key, so unit and type metadata
+// survive a round trip through the JSON/MessagePack codecs below.
+type resultValue struct {
+	Value interface{}
+	Unit  string
+	Type  ResultType
+}
+
 type (
 	// AgentResult describes the result from an agent.
-	AgentResult map[string]interface{}
+	AgentResult map[string]resultValue
 )
 
-// NewAgentResult will instanmtiate a new AgentResult ready for passing to an
+// NewAgentResult will instantiate a new AgentResult ready for passing to an
 // agent.
 func NewAgentResult() AgentResult {
-	return AgentResult(make(map[string]interface{}))
+	return AgentResult(make(map[string]resultValue))
 }
 
-// AddValue will add a result value.
+// AddValue will add a result value, inferring its ResultType from value's Go
+// type via reflection.
+//
+// Deprecated: use AddGauge, AddCounter, AddDuration or AddString instead,
+// which validate against a ResultSchema and record unit metadata.
 func (a AgentResult) AddValue(key string, value interface{}) {
-	a[key] = value
+	logger.Warn("plugins", "AddValue is deprecated for key %q, use AddGauge/AddCounter/AddDuration/AddString instead", key)
+
+	a[key] = resultValue{
+		Value: value,
+		Type:  inferType(value),
+	}
+}
+
+// inferType guesses a ResultType for a value passed to the deprecated
+// AddValue.
+func inferType(value interface{}) ResultType {
+	if _, ok := value.(time.Duration); ok {
+		return DurationType
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Bool:
+		return Bool
+
+	case reflect.String:
+		return String
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return Gauge
+
+	default:
+		return String
+	}
+}
+
+// AddGauge adds a point-in-time numeric measurement for key, validating it
+// against schema.
+func (a AgentResult) AddGauge(schema ResultSchema, key string, value float64) error {
+	return a.addTyped(schema, key, value, Gauge)
+}
+
+// AddCounter adds a monotonically increasing numeric measurement for key,
+// validating it against schema.
+func (a AgentResult) AddCounter(schema ResultSchema, key string, value float64) error {
+	return a.addTyped(schema, key, value, Counter)
+}
+
+// AddDuration adds a time.Duration measurement for key, validating it
+// against schema.
+func (a AgentResult) AddDuration(schema ResultSchema, key string, value time.Duration) error {
+	return a.addTyped(schema, key, value, DurationType)
+}
+
+// AddString adds a free-form text value for key, validating it against
+// schema.
+func (a AgentResult) AddString(schema ResultSchema, key string, value string) error {
+	return a.addTyped(schema, key, value, String)
+}
+
+func (a AgentResult) addTyped(schema ResultSchema, key string, value interface{}, t ResultType) error {
+	field, ok := schema.field(key)
+	if !ok {
+		return fmt.Errorf("%q is not part of this agent's ResultSchema", key)
+	}
+
+	if field.Type != t {
+		return fmt.Errorf("%q is a %s in this agent's ResultSchema, not a %s", key, field.Type, t)
+	}
+
+	a[key] = resultValue{
+		Value: value,
+		Unit:  field.Unit,
+		Type:  t,
+	}
+
+	return nil
+}
+
+// Get returns the value, unit and type recorded for key, and whether key was
+// present at all. This is the read-path counterpart to AddValue/AddGauge/
+// AddCounter/AddDuration/AddString for callers outside this package, since
+// resultValue itself isn't exported.
+func (a AgentResult) Get(key string) (value interface{}, unit string, typ ResultType, ok bool) {
+	v, ok := a[key]
+	if !ok {
+		return nil, "", "", false
+	}
+
+	return v.Value, v.Unit, v.Type, true
+}
+
+// Values returns a plain map[string]interface{} of the recorded values, with
+// unit/type metadata stripped. Use this to hand an AgentResult to code that
+// expects the bare map[string]interface{} shape AgentResult had before it
+// started tracking units.
+func (a AgentResult) Values() map[string]interface{} {
+	values := make(map[string]interface{}, len(a))
+	for key, v := range a {
+		values[key] = v.Value
+	}
+
+	return values
+}
+
+// resultFieldJSON is the wire representation of one AgentResult entry.
+type resultFieldJSON struct {
+	Name  string      `json:"name" msgpack:"name"`
+	Value interface{} `json:"value" msgpack:"value"`
+	Unit  string      `json:"unit,omitempty" msgpack:"unit,omitempty"`
+	Type  ResultType  `json:"type" msgpack:"type"`
+}
+
+func (a AgentResult) toWire() []resultFieldJSON {
+	fields := make([]resultFieldJSON, 0, len(a))
+	for name, v := range a {
+		fields = append(fields, resultFieldJSON{Name: name, Value: v.Value, Unit: v.Unit, Type: v.Type})
+	}
+
+	return fields
+}
+
+func (a *AgentResult) fromWire(fields []resultFieldJSON) {
+	result := make(map[string]resultValue, len(fields))
+	for _, f := range fields {
+		result[f.Name] = resultValue{Value: f.Value, Unit: f.Unit, Type: f.Type}
+	}
+
+	*a = result
+}
+
+// MarshalJSON emits AgentResult as a {name, value, unit, type} tuple per
+// field, so downstream consumers don't lose unit information the way a
+// plain map would.
+func (a AgentResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.toWire())
+}
+
+// UnmarshalJSON parses the {name, value, unit, type} tuples MarshalJSON
+// produces back into an AgentResult.
+func (a *AgentResult) UnmarshalJSON(data []byte) error {
+	var fields []resultFieldJSON
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	a.fromWire(fields)
+
+	return nil
+}
+
+// MarshalMsgpack implements msgpack.Marshaler, for on-wire use between
+// agents and the core.
+func (a AgentResult) MarshalMsgpack() ([]byte, error) {
+	return msgpack.Marshal(a.toWire())
+}
+
+// UnmarshalMsgpack implements msgpack.Unmarshaler.
+func (a *AgentResult) UnmarshalMsgpack(data []byte) error {
+	var fields []resultFieldJSON
+	if err := msgpack.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	a.fromWire(fields)
+
+	return nil
+}
+
+// byteUnitMultipliers maps the magnitude suffix a byte threshold like "5MB"
+// may carry to the number of bytes it represents. Longer suffixes are
+// listed before the shorter ones they end with (e.g. "MB" before "B") so
+// HasSuffix matches the most specific one first.
+var byteUnitMultipliers = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+}
+
+// parseByteQuantity parses expr as a number of bytes, accepting an optional
+// decimal (KB/MB/GB/TB) or binary (KiB/MiB/GiB/TiB) magnitude suffix, so a
+// threshold for a "bytes" field can be written as "5MB" instead of the raw
+// byte count.
+func parseByteQuantity(expr string) (float64, error) {
+	for _, u := range byteUnitMultipliers {
+		if !strings.HasSuffix(expr, u.suffix) {
+			continue
+		}
+
+		numeric := strings.TrimSpace(strings.TrimSuffix(expr, u.suffix))
+		if numeric == "" {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(numeric, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return value * u.multiplier, nil
+	}
+
+	return strconv.ParseFloat(expr, 64)
+}
+
+// ParseThreshold parses a threshold expression such as ">100ms" or "<5MB"
+// into a comparison operator and the float64 value it should be compared
+// against, interpreting the number according to field's type and unit.
+// Duration fields accept any time.ParseDuration syntax ("100ms", "2s");
+// fields whose Unit is "bytes" accept a KB/MB/GB/TB (or KiB/MiB/GiB/TiB)
+// magnitude suffix; every other field is parsed as a plain number.
+func ParseThreshold(field ResultField, expr string) (op string, value float64, err error) {
+	expr = strings.TrimSpace(expr)
+
+	for _, candidate := range []string{">=", "<=", "==", ">", "<"} {
+		if strings.HasPrefix(expr, candidate) {
+			op = candidate
+			expr = strings.TrimSpace(strings.TrimPrefix(expr, candidate))
+			break
+		}
+	}
+
+	if op == "" {
+		return "", 0, fmt.Errorf("threshold %q has no comparison operator", expr)
+	}
+
+	if expr == "" {
+		return "", 0, errors.New("threshold has no value")
+	}
+
+	if field.Type == DurationType {
+		d, err := time.ParseDuration(expr)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid duration in threshold: %w", err)
+		}
+
+		return op, float64(d), nil
+	}
+
+	if field.Unit == "bytes" {
+		value, err = parseByteQuantity(expr)
+	} else {
+		value, err = strconv.ParseFloat(expr, 64)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid number in threshold: %w", err)
+	}
+
+	return op, value, nil
+}
+
+// Evaluate reports whether the value recorded at key satisfies the
+// threshold expression expr (e.g. ">100ms"), resolving the unit through
+// schema. This is the plumbing evaluators use to compare a stored
+// AgentResult value against a threshold rule without having to know its
+// unit up front.
+func (a AgentResult) Evaluate(schema ResultSchema, key string, expr string) (bool, error) {
+	field, ok := schema.field(key)
+	if !ok {
+		return false, fmt.Errorf("%q is not part of this agent's ResultSchema", key)
+	}
+
+	stored, ok := a[key]
+	if !ok {
+		return false, fmt.Errorf("no value recorded for %q", key)
+	}
+
+	op, threshold, err := ParseThreshold(field, expr)
+	if err != nil {
+		return false, err
+	}
+
+	value, err := numericValue(stored.Value)
+	if err != nil {
+		return false, fmt.Errorf("%q: %w", key, err)
+	}
+
+	switch op {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	default:
+		return false, fmt.Errorf("unsupported operator %q", op)
+	}
+}
+
+// numericValue coerces a stored AgentResult value to a float64 for
+// comparison against a parsed threshold.
+func numericValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case time.Duration:
+		return float64(v), nil
+	default:
+		return 0, fmt.Errorf("value of type %T is not numeric", value)
+	}
 }
@@ -0,0 +1,207 @@
+package plugins
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var testSchema = ResultSchema{
+	{Name: "cpu", Type: Gauge, Unit: "%"},
+	{Name: "requests", Type: Counter, Unit: "requests"},
+	{Name: "latency", Type: DurationType},
+	{Name: "disk_free", Type: Gauge, Unit: "bytes"},
+	{Name: "hostname", Type: String},
+}
+
+func TestAddTypedRejectsUnknownKey(t *testing.T) {
+	result := NewAgentResult()
+
+	if err := result.AddGauge(testSchema, "nope", 1); err == nil {
+		t.Fatal("expected adding a key absent from the schema to fail")
+	}
+}
+
+func TestAddTypedRejectsTypeMismatch(t *testing.T) {
+	result := NewAgentResult()
+
+	if err := result.AddCounter(testSchema, "cpu", 1); err == nil {
+		t.Fatal("expected adding a Counter value for a Gauge field to fail")
+	}
+}
+
+func TestAddTypedRecordsUnitFromSchema(t *testing.T) {
+	result := NewAgentResult()
+
+	if err := result.AddGauge(testSchema, "cpu", 42); err != nil {
+		t.Fatalf("AddGauge failed: %s", err)
+	}
+
+	value, unit, typ, ok := result.Get("cpu")
+	if !ok {
+		t.Fatal("expected cpu to be recorded")
+	}
+
+	if value != 42.0 || unit != "%" || typ != Gauge {
+		t.Fatalf("got value=%v unit=%q type=%v, want value=42 unit=%% type=gauge", value, unit, typ)
+	}
+}
+
+func TestAddValueInfersTypeAndSkipsSchema(t *testing.T) {
+	result := NewAgentResult()
+
+	result.AddValue("count", 3)
+	result.AddValue("name", "agent1")
+	result.AddValue("enabled", true)
+	result.AddValue("elapsed", 2*time.Second)
+
+	cases := map[string]ResultType{
+		"count":   Gauge,
+		"name":    String,
+		"enabled": Bool,
+		"elapsed": DurationType,
+	}
+
+	for key, want := range cases {
+		_, _, typ, ok := result.Get(key)
+		if !ok {
+			t.Fatalf("expected %q to be recorded", key)
+		}
+
+		if typ != want {
+			t.Errorf("AddValue(%q) inferred type %v, want %v", key, typ, want)
+		}
+	}
+}
+
+func TestValuesReturnsPlainMap(t *testing.T) {
+	result := NewAgentResult()
+	result.AddValue("count", 3)
+
+	values := result.Values()
+
+	n, ok := values["count"].(int)
+	if !ok || n != 3 {
+		t.Fatalf("expected Values() to expose a raw int for count, got %#v", values["count"])
+	}
+}
+
+func TestAgentResultJSONRoundTrip(t *testing.T) {
+	result := NewAgentResult()
+	if err := result.AddGauge(testSchema, "cpu", 12.5); err != nil {
+		t.Fatalf("AddGauge failed: %s", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	var decoded AgentResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	value, unit, typ, ok := decoded.Get("cpu")
+	if !ok {
+		t.Fatal("expected cpu to survive the round trip")
+	}
+
+	if value != 12.5 || unit != "%" || typ != Gauge {
+		t.Fatalf("got value=%v unit=%q type=%v after round trip, want value=12.5 unit=%% type=gauge", value, unit, typ)
+	}
+}
+
+func TestAgentResultMsgpackRoundTrip(t *testing.T) {
+	result := NewAgentResult()
+	if err := result.AddCounter(testSchema, "requests", 7); err != nil {
+		t.Fatalf("AddCounter failed: %s", err)
+	}
+
+	data, err := result.MarshalMsgpack()
+	if err != nil {
+		t.Fatalf("MarshalMsgpack failed: %s", err)
+	}
+
+	var decoded AgentResult
+	if err := decoded.UnmarshalMsgpack(data); err != nil {
+		t.Fatalf("UnmarshalMsgpack failed: %s", err)
+	}
+
+	value, unit, typ, ok := decoded.Get("requests")
+	if !ok {
+		t.Fatal("expected requests to survive the round trip")
+	}
+
+	if value != 7.0 || unit != "requests" || typ != Counter {
+		t.Fatalf("got value=%v unit=%q type=%v after round trip, want value=7 unit=requests type=counter", value, unit, typ)
+	}
+}
+
+func TestParseThresholdDuration(t *testing.T) {
+	field, _ := testSchema.field("latency")
+
+	op, value, err := ParseThreshold(field, ">100ms")
+	if err != nil {
+		t.Fatalf("ParseThreshold failed: %s", err)
+	}
+
+	if op != ">" || value != float64(100*time.Millisecond) {
+		t.Fatalf("got op=%q value=%v, want op=> value=%v", op, value, float64(100*time.Millisecond))
+	}
+}
+
+func TestParseThresholdBytes(t *testing.T) {
+	field, _ := testSchema.field("disk_free")
+
+	cases := map[string]float64{
+		"<5MB":  5e6,
+		"<5KB":  5e3,
+		"<1GiB": 1 << 30,
+		"<512":  512,
+	}
+
+	for expr, want := range cases {
+		_, value, err := ParseThreshold(field, expr)
+		if err != nil {
+			t.Fatalf("ParseThreshold(%q) failed: %s", expr, err)
+		}
+
+		if value != want {
+			t.Errorf("ParseThreshold(%q) = %v, want %v", expr, value, want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	result := NewAgentResult()
+	if err := result.AddGauge(testSchema, "disk_free", 2e6); err != nil {
+		t.Fatalf("AddGauge failed: %s", err)
+	}
+
+	ok, err := result.Evaluate(testSchema, "disk_free", "<5MB")
+	if err != nil {
+		t.Fatalf("Evaluate failed: %s", err)
+	}
+
+	if !ok {
+		t.Fatal("expected 2e6 bytes to satisfy <5MB")
+	}
+
+	ok, err = result.Evaluate(testSchema, "disk_free", ">5MB")
+	if err != nil {
+		t.Fatalf("Evaluate failed: %s", err)
+	}
+
+	if ok {
+		t.Fatal("expected 2e6 bytes to not satisfy >5MB")
+	}
+}
+
+func TestEvaluateMissingKey(t *testing.T) {
+	result := NewAgentResult()
+
+	if _, err := result.Evaluate(testSchema, "disk_free", "<5MB"); err == nil {
+		t.Fatal("expected evaluating a key with no recorded value to fail")
+	}
+}